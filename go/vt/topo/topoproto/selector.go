@@ -0,0 +1,449 @@
+/*
+Copyright 2019 The Vitess Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package topoproto
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"vitess.io/vitess/go/vt/vterrors"
+
+	topodatapb "vitess.io/vitess/go/vt/proto/topodata"
+	vtctldatapb "vitess.io/vitess/go/vt/proto/vtctldata"
+)
+
+// This file contains a composable filter over topodata.Tablet, intended to
+// replace the ad-hoc pairing of ParseTabletSet and ParseTabletTypes that
+// callers have historically built up by hand.
+
+// TabletPredicate is a single filtering condition over a *topodatapb.Tablet.
+type TabletPredicate func(*topodatapb.Tablet) bool
+
+// TabletSelector composes criteria that are ANDed together when matching
+// against tablets. Build one with NewTabletSelector or ParseSelector and use
+// Matches or Filter to apply it.
+//
+// Each built-in criterion (cells, types, keyspace, shard, tags, serving) is
+// widened or replaced by calling its method again, rather than adding a
+// second, independently-ANDed restriction -- e.g. InCells("a").InCells("b")
+// matches cells a or b, the same as a single InCells("a", "b") call, and
+// InKeyspace("a").InKeyspace("b") matches keyspace "b". This keeps repeated
+// calls (as CLI flags like repeated --cell flags naturally produce)
+// consistent with what ToProto/TabletSelectorFromProto serialize. Custom and
+// a healthcheck-backed Serving callback have no declarative form and make a
+// selector unconvertible; see ToProto.
+type TabletSelector struct {
+	cells    []string
+	types    []topodatapb.TabletType
+	keyspace string
+	shard    string
+
+	exactTags        map[string]string // from WithTags; checked directly against Tags, not via tagSelector
+	tagSelectorTerms []string          // from WithTagSelector, accumulated terms
+	tagSelector      *TagSelector      // compiled from tagSelectorTerms
+
+	hasServing      bool
+	servingCallback func(*topodatapb.Tablet) bool
+
+	custom []TabletPredicate
+}
+
+// NewTabletSelector returns an empty TabletSelector, which matches every
+// tablet until criteria are added to it.
+func NewTabletSelector() *TabletSelector {
+	return &TabletSelector{}
+}
+
+// InCells restricts matches to tablets in one of the given cells. Calling it
+// more than once widens the set of cells rather than requiring all of them
+// at once. Calling it with no cells is a no-op.
+func (s *TabletSelector) InCells(cells ...string) *TabletSelector {
+	s.cells = append(s.cells, cells...)
+	return s
+}
+
+// OfTypes restricts matches to tablets of one of the given types. BATCH and
+// RDONLY are treated as aliases of each other, mirroring how
+// MakeUniqueStringTypeList treats the pair. Calling it more than once widens
+// the set of types rather than requiring all of them at once. Calling it
+// with no types is a no-op.
+func (s *TabletSelector) OfTypes(types ...topodatapb.TabletType) *TabletSelector {
+	s.types = append(s.types, types...)
+	return s
+}
+
+// InKeyspace restricts matches to tablets belonging to the given keyspace.
+// Calling it again replaces the keyspace, since a tablet belongs to exactly
+// one.
+func (s *TabletSelector) InKeyspace(keyspace string) *TabletSelector {
+	s.keyspace = keyspace
+	return s
+}
+
+// InShard restricts matches to tablets belonging to the given shard. Shard
+// names are only unique within a keyspace, so callers typically pair this
+// with InKeyspace. Calling it again replaces the shard, since a tablet
+// belongs to exactly one.
+func (s *TabletSelector) InShard(shard string) *TabletSelector {
+	s.shard = shard
+	return s
+}
+
+// WithTags restricts matches to tablets whose Tags contain every key/value
+// pair given, compared directly against the tablet's Tags map. Tablets
+// carrying additional tags beyond those given still match. Calling this more
+// than once adds more required pairs, all of which must hold; a later call
+// overwrites the value for a key given in an earlier call.
+//
+// A key or value containing "=", ",", "(", ")", "!", or leading/trailing
+// whitespace has no representation in the tag_selector DSL used by String
+// and ToProto; Matches still honors it exactly, but ToProto returns an error
+// rather than silently emitting a string that would parse back differently.
+func (s *TabletSelector) WithTags(tags map[string]string) *TabletSelector {
+	if len(tags) == 0 {
+		return s
+	}
+	if s.exactTags == nil {
+		s.exactTags = make(map[string]string, len(tags))
+	}
+	for k, v := range tags {
+		s.exactTags[k] = v
+	}
+	return s
+}
+
+// WithTagSelector restricts matches to tablets satisfying the given
+// Kubernetes-style tag selector (see ParseTagSelector), e.g.
+// "env=prod,!canary". It supports negation and set membership, which
+// WithTags does not. Calling this (or WithTagSelector again) more than once
+// adds more tag requirements, all of which must hold.
+func (s *TabletSelector) WithTagSelector(selector string) (*TabletSelector, error) {
+	terms, err := splitTagTerms(strings.TrimSpace(selector))
+	if err != nil {
+		return nil, err
+	}
+	var nonEmpty []string
+	for _, term := range terms {
+		if term = strings.TrimSpace(term); term != "" {
+			nonEmpty = append(nonEmpty, term)
+		}
+	}
+	if len(nonEmpty) == 0 {
+		return s, nil
+	}
+
+	// Validate the combined term list before touching selector state, so a
+	// bad call leaves the selector exactly as it was rather than corrupting
+	// it with terms that were never folded into tagSelector.
+	combined := append(append([]string(nil), s.tagSelectorTerms...), nonEmpty...)
+	compiled, err := ParseTagSelector(strings.Join(combined, ","))
+	if err != nil {
+		return nil, err
+	}
+	s.tagSelectorTerms = combined
+	s.tagSelector = compiled
+	return s, nil
+}
+
+// Serving restricts matches to tablets whose type is a serving type, per
+// IsServingType. topoproto has no visibility into live healthcheck state, so
+// callers that want to also require the tablet to be currently healthy
+// should pass isServing (e.g. backed by a discovery.TabletHealth map); it is
+// consulted only for tablets that already pass the serving-type check.
+func (s *TabletSelector) Serving(isServing func(*topodatapb.Tablet) bool) *TabletSelector {
+	s.hasServing = true
+	s.servingCallback = isServing
+	return s
+}
+
+// Custom adds an arbitrary predicate, for conditions not otherwise covered by
+// the selector's built-in methods. Custom predicates are not represented in
+// String, ParseSelector, or ToProto.
+func (s *TabletSelector) Custom(pred TabletPredicate) *TabletSelector {
+	s.custom = append(s.custom, pred)
+	return s
+}
+
+// Matches returns true if the tablet satisfies every criterion added to the
+// selector. An empty selector matches everything.
+func (s *TabletSelector) Matches(t *topodatapb.Tablet) bool {
+	if len(s.cells) > 0 {
+		if t.Alias == nil {
+			return false
+		}
+		if !stringInList(t.Alias.Cell, s.cells) {
+			return false
+		}
+	}
+
+	if len(s.types) > 0 && !typeInList(t.Type, s.types) {
+		return false
+	}
+
+	if s.keyspace != "" && t.Keyspace != s.keyspace {
+		return false
+	}
+
+	if s.shard != "" && t.Shard != s.shard {
+		return false
+	}
+
+	for k, v := range s.exactTags {
+		if t.Tags[k] != v {
+			return false
+		}
+	}
+
+	if s.tagSelector != nil && !s.tagSelector.Matches(t) {
+		return false
+	}
+
+	if s.hasServing {
+		if !IsServingType(t.Type) {
+			return false
+		}
+		if s.servingCallback != nil && !s.servingCallback(t) {
+			return false
+		}
+	}
+
+	for _, pred := range s.custom {
+		if !pred(t) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func stringInList(s string, list []string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// typeInList returns true if tabletType is in types, treating BATCH and
+// RDONLY as aliases of each other.
+func typeInList(tabletType topodatapb.TabletType, types []topodatapb.TabletType) bool {
+	for _, t := range types {
+		if t == tabletType {
+			return true
+		}
+		if (t == topodatapb.TabletType_BATCH && tabletType == topodatapb.TabletType_RDONLY) ||
+			(t == topodatapb.TabletType_RDONLY && tabletType == topodatapb.TabletType_BATCH) {
+			return true
+		}
+	}
+	return false
+}
+
+// Filter returns the subset of tablets that match the selector, preserving
+// their relative order.
+func (s *TabletSelector) Filter(tablets []*topodatapb.Tablet) []*topodatapb.Tablet {
+	result := make([]*topodatapb.Tablet, 0, len(tablets))
+	for _, t := range tablets {
+		if s.Matches(t) {
+			result = append(result, t)
+		}
+	}
+	return result
+}
+
+// String returns the selector in the same DSL accepted by ParseSelector. This
+// is what callers should use to plumb a selector through CLI flags and
+// vtctld RPCs that carry a plain string today; Custom and Serving predicates,
+// which depend on Go closures or runtime healthcheck state, are omitted.
+//
+// Unlike ToProto, String never errors: a WithTags key or value that cannot be
+// represented in the tag_selector DSL (see tagTermsForSerialization) is
+// rendered anyway, best-effort, and will not parse back to an equivalent
+// selector. Prefer ToProto when round-trip fidelity matters.
+func (s *TabletSelector) String() string {
+	var clauses []string
+	if len(s.cells) > 0 {
+		clauses = append(clauses, "cell="+strings.Join(s.cells, ","))
+	}
+	if len(s.types) > 0 {
+		clauses = append(clauses, "type="+strings.Join(MakeUniqueStringTypeList(s.types), ","))
+	}
+	if s.keyspace != "" {
+		clauses = append(clauses, "keyspace="+s.keyspace)
+	}
+	if s.shard != "" {
+		clauses = append(clauses, "shard="+s.shard)
+	}
+	if tagTerms, _ := s.tagTermsForSerialization(); len(tagTerms) > 0 {
+		clauses = append(clauses, "tag:"+strings.Join(tagTerms, ","))
+	}
+	if s.hasServing {
+		clauses = append(clauses, "serving=true")
+	}
+	return strings.Join(clauses, ";")
+}
+
+// unsafeTagTermRunes are characters that splitTagTerms/parseTagTerm treat as
+// grammar, rather than literal data: "," separates terms, "(" and ")" track
+// "in (...)" nesting, "=" separates a key from its value, and "!" introduces
+// the negation and not-equal operators. A key or value containing one of
+// them cannot be rendered as a "k=v" term without changing what it parses
+// back to.
+const unsafeTagTermRunes = ",()=!"
+
+// tagTermsForSerialization renders exactTags and tagSelectorTerms as a single
+// list of ParseTagSelector-compatible terms, for use by String and ToProto.
+// It also reports whether every exactTags entry survives that round trip
+// unchanged; WithTags itself never parses tag values through this grammar --
+// see Matches and WithTags -- so a value containing one of
+// unsafeTagTermRunes, or leading/trailing whitespace, would silently change
+// meaning (or fail to parse) if serialized this way.
+func (s *TabletSelector) tagTermsForSerialization() (terms []string, exact bool) {
+	exact = true
+	if len(s.exactTags) > 0 {
+		frags := make([]string, 0, len(s.exactTags))
+		for k, v := range s.exactTags {
+			if strings.ContainsAny(k, unsafeTagTermRunes) || strings.ContainsAny(v, unsafeTagTermRunes) ||
+				k != strings.TrimSpace(k) || v != strings.TrimSpace(v) {
+				exact = false
+			}
+			frags = append(frags, fmt.Sprintf("%s=%s", k, v))
+		}
+		sort.Strings(frags)
+		terms = append(terms, frags...)
+	}
+	terms = append(terms, s.tagSelectorTerms...)
+	return terms, exact
+}
+
+// ParseSelector parses a TabletSelector out of a concise DSL of
+// semicolon-separated clauses, e.g.:
+//
+//	cell=zone1,zone2;type=replica,rdonly;keyspace=commerce;shard=-80;tag:env=prod
+//
+// Each clause corresponds to the selector method of the same name (InCells,
+// OfTypes, InKeyspace, InShard); tag: clauses are accumulated into a single
+// TagSelector (see ParseTagSelector) and may be repeated to add more than one
+// tag requirement, including the "!=", "in (...)"  and "!" forms. Serving and
+// Custom predicates cannot be expressed in the DSL since they depend on
+// runtime state or Go closures; callers that need them should call those
+// methods on the returned selector directly.
+func ParseSelector(dsl string) (*TabletSelector, error) {
+	sel := NewTabletSelector()
+	dsl = strings.TrimSpace(dsl)
+	if dsl == "" {
+		return sel, nil
+	}
+
+	var tagTerms []string
+	for _, clause := range strings.Split(dsl, ";") {
+		clause = strings.TrimSpace(clause)
+		if clause == "" {
+			continue
+		}
+		if rest, ok := strings.CutPrefix(clause, "tag:"); ok {
+			if rest == "" {
+				return nil, fmt.Errorf("empty tag clause in selector %q", dsl)
+			}
+			tagTerms = append(tagTerms, rest)
+			continue
+		}
+
+		key, value, ok := strings.Cut(clause, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid clause %q in selector %q", clause, dsl)
+		}
+		switch key {
+		case "cell":
+			sel.InCells(strings.Split(value, ",")...)
+		case "type":
+			types, err := ParseTabletTypes(value)
+			if err != nil {
+				return nil, vterrors.Wrapf(err, "invalid type clause in selector %q", dsl)
+			}
+			sel.OfTypes(types...)
+		case "keyspace":
+			sel.InKeyspace(value)
+		case "shard":
+			sel.InShard(value)
+		default:
+			return nil, fmt.Errorf("unknown selector key %q in selector %q", key, dsl)
+		}
+	}
+	if len(tagTerms) > 0 {
+		if _, err := sel.WithTagSelector(strings.Join(tagTerms, ",")); err != nil {
+			return nil, vterrors.Wrapf(err, "invalid tag clause in selector %q", dsl)
+		}
+	}
+	return sel, nil
+}
+
+// ToProto serializes the selector's declarative criteria (cells, types,
+// keyspace, shard, tag selector, serving) to a vtctldata.TabletSelector, so
+// it can travel over topo/vtctld RPCs instead of the ad-hoc comma-separated
+// strings ParseTabletSet/ParseTabletTypes previously required. It returns an
+// error if the selector has a Custom predicate or a Serving healthcheck
+// callback, since neither has a wire representation, or if a tag added via
+// WithTags has a key or value that cannot be represented as a "k=v" term in
+// the tag_selector DSL (see tagTermsForSerialization) without changing its
+// meaning.
+func (s *TabletSelector) ToProto() (*vtctldatapb.TabletSelector, error) {
+	if len(s.custom) > 0 || s.servingCallback != nil {
+		return nil, fmt.Errorf("TabletSelector has a Custom predicate or a Serving healthcheck callback, which cannot be converted to a TabletSelector proto message")
+	}
+	tagTerms, exact := s.tagTermsForSerialization()
+	if !exact {
+		return nil, fmt.Errorf("TabletSelector has a WithTags key or value that cannot be represented in the tag_selector proto field without changing its meaning")
+	}
+	return &vtctldatapb.TabletSelector{
+		Cells:       append([]string(nil), s.cells...),
+		TabletTypes: append([]topodatapb.TabletType(nil), s.types...),
+		Keyspace:    s.keyspace,
+		Shard:       s.shard,
+		TagSelector: strings.Join(tagTerms, ","),
+		Serving:     s.hasServing,
+	}, nil
+}
+
+// TabletSelectorFromProto builds a TabletSelector from its wire
+// representation, as produced by TabletSelector.ToProto. A nil message
+// returns an empty selector that matches everything.
+func TabletSelectorFromProto(msg *vtctldatapb.TabletSelector) (*TabletSelector, error) {
+	sel := NewTabletSelector()
+	if msg == nil {
+		return sel, nil
+	}
+	sel.InCells(msg.Cells...)
+	sel.OfTypes(msg.TabletTypes...)
+	if msg.Keyspace != "" {
+		sel.InKeyspace(msg.Keyspace)
+	}
+	if msg.Shard != "" {
+		sel.InShard(msg.Shard)
+	}
+	if msg.TagSelector != "" {
+		if _, err := sel.WithTagSelector(msg.TagSelector); err != nil {
+			return nil, vterrors.Wrapf(err, "invalid tag_selector in TabletSelector proto")
+		}
+	}
+	if msg.Serving {
+		sel.Serving(nil)
+	}
+	return sel, nil
+}
@@ -0,0 +1,306 @@
+/*
+Copyright 2019 The Vitess Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package topoproto
+
+import (
+	"testing"
+
+	topodatapb "vitess.io/vitess/go/vt/proto/topodata"
+)
+
+func tabletForSelectorTest(cell string, uid uint32, keyspace, shard string, tabletType topodatapb.TabletType, tags map[string]string) *topodatapb.Tablet {
+	return &topodatapb.Tablet{
+		Alias:    &topodatapb.TabletAlias{Cell: cell, Uid: uid},
+		Keyspace: keyspace,
+		Shard:    shard,
+		Type:     tabletType,
+		Tags:     tags,
+	}
+}
+
+func TestTabletSelectorMatches(t *testing.T) {
+	replicaZone1 := tabletForSelectorTest("zone1", 100, "commerce", "-80", topodatapb.TabletType_REPLICA, map[string]string{"env": "prod"})
+	rdonlyZone2 := tabletForSelectorTest("zone2", 200, "commerce", "80-", topodatapb.TabletType_RDONLY, nil)
+	drainedZone1 := tabletForSelectorTest("zone1", 1, "commerce", "-80", topodatapb.TabletType_DRAINED, nil)
+
+	cases := []struct {
+		name     string
+		selector *TabletSelector
+		want     bool
+		tablet   *topodatapb.Tablet
+	}{
+		{"InCells match", NewTabletSelector().InCells("zone1", "zone3"), true, replicaZone1},
+		{"InCells no match", NewTabletSelector().InCells("zone3"), false, replicaZone1},
+		{"InCells empty is no-op", NewTabletSelector().InCells(), true, replicaZone1},
+		{"OfTypes match", NewTabletSelector().OfTypes(topodatapb.TabletType_REPLICA), true, replicaZone1},
+		{"OfTypes BATCH aliases RDONLY", NewTabletSelector().OfTypes(topodatapb.TabletType_BATCH), true, rdonlyZone2},
+		{"OfTypes no match", NewTabletSelector().OfTypes(topodatapb.TabletType_DRAINED), false, replicaZone1},
+		{"InKeyspace match", NewTabletSelector().InKeyspace("commerce"), true, replicaZone1},
+		{"InKeyspace no match", NewTabletSelector().InKeyspace("customer"), false, replicaZone1},
+		{"InShard match", NewTabletSelector().InShard("-80"), true, replicaZone1},
+		{"InShard no match", NewTabletSelector().InShard("80-"), false, replicaZone1},
+		{"WithTags match", NewTabletSelector().WithTags(map[string]string{"env": "prod"}), true, replicaZone1},
+		{"WithTags missing tag", NewTabletSelector().WithTags(map[string]string{"env": "prod"}), false, rdonlyZone2},
+		{"Serving without callback", NewTabletSelector().Serving(nil), true, replicaZone1},
+		{"Serving rejects non-serving type", NewTabletSelector().Serving(nil), false, drainedZone1},
+		{
+			"Serving with callback", NewTabletSelector().Serving(func(tab *topodatapb.Tablet) bool {
+				return tab.Alias.Uid == 100
+			}), true, replicaZone1,
+		},
+		{"Custom predicate", NewTabletSelector().Custom(func(tab *topodatapb.Tablet) bool { return tab.Shard == "-80" }), true, replicaZone1},
+		{
+			"composed predicates all must match",
+			NewTabletSelector().InKeyspace("commerce").InCells("zone1").OfTypes(topodatapb.TabletType_REPLICA),
+			true, replicaZone1,
+		},
+		{
+			"composed predicates short circuit on first failure",
+			NewTabletSelector().InKeyspace("commerce").InCells("zone9"),
+			false, replicaZone1,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := c.selector.Matches(c.tablet); got != c.want {
+				t.Errorf("Matches() = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestTabletSelectorFilter(t *testing.T) {
+	tablets := []*topodatapb.Tablet{
+		tabletForSelectorTest("zone1", 1, "commerce", "-80", topodatapb.TabletType_REPLICA, nil),
+		tabletForSelectorTest("zone2", 2, "commerce", "-80", topodatapb.TabletType_REPLICA, nil),
+		tabletForSelectorTest("zone1", 3, "commerce", "-80", topodatapb.TabletType_PRIMARY, nil),
+	}
+
+	got := NewTabletSelector().InCells("zone1").Filter(tablets)
+	if len(got) != 2 {
+		t.Fatalf("Filter() returned %d tablets, want 2", len(got))
+	}
+	if got[0].Alias.Uid != 1 || got[1].Alias.Uid != 3 {
+		t.Errorf("Filter() did not preserve order: got uids %d, %d", got[0].Alias.Uid, got[1].Alias.Uid)
+	}
+}
+
+func TestTabletSelectorRepeatedCalls(t *testing.T) {
+	zone1 := tabletForSelectorTest("zone1", 1, "commerce", "-80", topodatapb.TabletType_REPLICA, nil)
+	zone2 := tabletForSelectorTest("zone2", 2, "commerce", "-80", topodatapb.TabletType_REPLICA, nil)
+
+	// Calling InCells/OfTypes more than once widens the match set, the same
+	// as passing all the values in one call -- it must not AND together two
+	// impossible-to-satisfy-at-once restrictions.
+	widened := NewTabletSelector().InCells("zone1").InCells("zone2")
+	if !widened.Matches(zone1) || !widened.Matches(zone2) {
+		t.Errorf("InCells called twice should match both cells, matched zone1=%v zone2=%v", widened.Matches(zone1), widened.Matches(zone2))
+	}
+
+	// InKeyspace/InShard are single-valued per tablet, so calling them again
+	// replaces the restriction instead of requiring both values at once.
+	replaced := NewTabletSelector().InKeyspace("customer").InKeyspace("commerce")
+	if !replaced.Matches(zone1) {
+		t.Errorf("InKeyspace called twice should keep only the latest value, want it to match keyspace %q", zone1.Keyspace)
+	}
+}
+
+func TestTabletSelectorWithTagsExactMatch(t *testing.T) {
+	// WithTags must compare tag values directly against the tablet's Tags map,
+	// not via the "tag:" DSL grammar, since values that round-trip through
+	// that grammar get trimmed and comma-split.
+	spacedZone1 := tabletForSelectorTest("zone1", 1, "commerce", "-80", topodatapb.TabletType_REPLICA, map[string]string{"env": " prod "})
+	trimmedZone1 := tabletForSelectorTest("zone1", 2, "commerce", "-80", topodatapb.TabletType_REPLICA, map[string]string{"env": "prod"})
+	listZone1 := tabletForSelectorTest("zone1", 3, "commerce", "-80", topodatapb.TabletType_REPLICA, map[string]string{"list": "a,b"})
+
+	sel := NewTabletSelector().WithTags(map[string]string{"env": " prod "})
+	if !sel.Matches(spacedZone1) {
+		t.Errorf("WithTags(%q) should match a tablet tagged with the exact same value", " prod ")
+	}
+	if sel.Matches(trimmedZone1) {
+		t.Errorf("WithTags(%q) should not match a tablet tagged %q", " prod ", "prod")
+	}
+
+	commaSel := NewTabletSelector().WithTags(map[string]string{"list": "a,b"})
+	if !commaSel.Matches(listZone1) {
+		t.Errorf("WithTags with a comma-containing value should match a tablet tagged with the exact same value")
+	}
+
+	// Neither selector can be safely serialized: their tag values would parse
+	// back differently (or not at all) through the tag_selector DSL.
+	if _, err := sel.ToProto(); err == nil {
+		t.Errorf("ToProto() returned no error for a WithTags value with leading/trailing whitespace, want one")
+	}
+	if _, err := commaSel.ToProto(); err == nil {
+		t.Errorf("ToProto() returned no error for a WithTags value containing a comma, want one")
+	}
+
+	// String(), unlike ToProto, never errors -- it renders such values
+	// best-effort, which is lossy: it no longer round-trips through
+	// ParseSelector to an equivalent selector.
+	if got, want := sel.String(), "tag:env= prod "; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
+
+func TestTabletSelectorWithTagSelectorLeavesStateUnchangedOnError(t *testing.T) {
+	sel := NewTabletSelector()
+	if _, err := sel.WithTagSelector("env=prod"); err != nil {
+		t.Fatalf("WithTagSelector(%q) returned error %v", "env=prod", err)
+	}
+	if _, err := sel.WithTagSelector("not a valid term"); err == nil {
+		t.Fatalf("WithTagSelector(%q) returned no error, want one", "not a valid term")
+	}
+
+	// The failed call must not have mutated the accumulated tag requirements:
+	// the selector should still behave exactly as it did after the first,
+	// successful call.
+	tablet := tabletForSelectorTest("zone1", 1, "commerce", "-80", topodatapb.TabletType_REPLICA, map[string]string{"env": "prod"})
+	if !sel.Matches(tablet) {
+		t.Errorf("selector should still match on env=prod after a failed WithTagSelector call")
+	}
+	if got, want := sel.String(), "tag:env=prod"; got != want {
+		t.Errorf("String() = %q after a failed WithTagSelector call, want %q", got, want)
+	}
+}
+
+func TestTabletSelectorRepeatedCallsProtoRoundTrip(t *testing.T) {
+	sel := NewTabletSelector().InCells("zone1").InCells("zone2")
+	msg, err := sel.ToProto()
+	if err != nil {
+		t.Fatalf("ToProto() failed: %v", err)
+	}
+	restored, err := TabletSelectorFromProto(msg)
+	if err != nil {
+		t.Fatalf("TabletSelectorFromProto() failed: %v", err)
+	}
+
+	zone1 := tabletForSelectorTest("zone1", 1, "commerce", "-80", topodatapb.TabletType_REPLICA, nil)
+	zone2 := tabletForSelectorTest("zone2", 2, "commerce", "-80", topodatapb.TabletType_REPLICA, nil)
+	if sel.Matches(zone1) != restored.Matches(zone1) || sel.Matches(zone2) != restored.Matches(zone2) {
+		t.Errorf("proto round trip changed behavior: original zone1=%v zone2=%v, restored zone1=%v zone2=%v",
+			sel.Matches(zone1), sel.Matches(zone2), restored.Matches(zone1), restored.Matches(zone2))
+	}
+}
+
+func TestParseSelector(t *testing.T) {
+	tablet := tabletForSelectorTest("zone1", 1, "commerce", "-80", topodatapb.TabletType_REPLICA, map[string]string{"env": "prod"})
+
+	cases := []struct {
+		dsl     string
+		want    bool
+		wantErr bool
+	}{
+		{"", true, false},
+		{"cell=zone1,zone2", true, false},
+		{"cell=zone9", false, false},
+		{"type=replica,rdonly", true, false},
+		{"keyspace=commerce;shard=-80", true, false},
+		{"keyspace=customer", false, false},
+		{"tag:env=prod", true, false},
+		{"tag:env!=prod", false, false},
+		{"cell=zone1;type=replica;keyspace=commerce;shard=-80;tag:env=prod", true, false},
+		{"bogus", false, true},
+		{"unknownkey=foo", false, true},
+		{"type=bogus", false, true},
+		{"tag:", false, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.dsl, func(t *testing.T) {
+			sel, err := ParseSelector(c.dsl)
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("ParseSelector(%q) returned no error, want one", c.dsl)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseSelector(%q) returned error %v", c.dsl, err)
+			}
+			if got := sel.Matches(tablet); got != c.want {
+				t.Errorf("ParseSelector(%q).Matches() = %v, want %v", c.dsl, got, c.want)
+			}
+		})
+	}
+}
+
+func TestTabletSelectorStringRoundTrip(t *testing.T) {
+	sel := NewTabletSelector().InCells("zone1", "zone2").InKeyspace("commerce")
+	dsl := sel.String()
+
+	reparsed, err := ParseSelector(dsl)
+	if err != nil {
+		t.Fatalf("ParseSelector(%q) failed: %v", dsl, err)
+	}
+
+	tablet := tabletForSelectorTest("zone1", 1, "commerce", "-80", topodatapb.TabletType_REPLICA, nil)
+	if !reparsed.Matches(tablet) {
+		t.Errorf("selector round-tripped through String()/ParseSelector() no longer matches a tablet it should")
+	}
+}
+
+func TestTabletSelectorProtoRoundTrip(t *testing.T) {
+	sel := NewTabletSelector().
+		InCells("zone1").
+		OfTypes(topodatapb.TabletType_REPLICA).
+		InKeyspace("commerce").
+		InShard("-80").
+		WithTags(map[string]string{"env": "prod"}).
+		Serving(nil)
+
+	msg, err := sel.ToProto()
+	if err != nil {
+		t.Fatalf("ToProto() failed: %v", err)
+	}
+
+	restored, err := TabletSelectorFromProto(msg)
+	if err != nil {
+		t.Fatalf("TabletSelectorFromProto() failed: %v", err)
+	}
+
+	matching := tabletForSelectorTest("zone1", 1, "commerce", "-80", topodatapb.TabletType_REPLICA, map[string]string{"env": "prod"})
+	nonMatching := tabletForSelectorTest("zone2", 2, "commerce", "-80", topodatapb.TabletType_REPLICA, map[string]string{"env": "prod"})
+
+	if !restored.Matches(matching) {
+		t.Errorf("selector round-tripped through ToProto()/TabletSelectorFromProto() no longer matches a tablet it should")
+	}
+	if restored.Matches(nonMatching) {
+		t.Errorf("selector round-tripped through ToProto()/TabletSelectorFromProto() matches a tablet it shouldn't")
+	}
+}
+
+func TestTabletSelectorToProtoRejectsUnconvertible(t *testing.T) {
+	cases := []struct {
+		name     string
+		selector *TabletSelector
+	}{
+		{"Custom predicate", NewTabletSelector().Custom(func(*topodatapb.Tablet) bool { return true })},
+		{"Serving with healthcheck callback", NewTabletSelector().Serving(func(*topodatapb.Tablet) bool { return true })},
+		{"WithTags value containing a comma", NewTabletSelector().WithTags(map[string]string{"list": "a,b"})},
+		{"WithTags value with leading/trailing whitespace", NewTabletSelector().WithTags(map[string]string{"env": " prod "})},
+		{"WithTags key containing '!'", NewTabletSelector().WithTags(map[string]string{"status!": "live"})},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if _, err := c.selector.ToProto(); err == nil {
+				t.Errorf("ToProto() returned no error for a selector with %s, want one", c.name)
+			}
+		})
+	}
+}
@@ -0,0 +1,287 @@
+/*
+Copyright 2019 The Vitess Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package topoproto
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"vitess.io/vitess/go/vt/vterrors"
+
+	topodatapb "vitess.io/vitess/go/vt/proto/topodata"
+)
+
+// This file contains helpers for the Tags map on topodata.Tablet, so that
+// consumers that want to route or throttle by tag don't have to hand-roll
+// map walks over it.
+
+// TabletHasTag returns true if tablet carries the given tag with exactly the
+// given value.
+func TabletHasTag(t *topodatapb.Tablet, key, value string) bool {
+	if t == nil {
+		return false
+	}
+	v, ok := t.Tags[key]
+	return ok && v == value
+}
+
+// tagOp is one requirement within a TagSelector.
+type tagOp int
+
+const (
+	tagOpEquals tagOp = iota
+	tagOpNotEquals
+	tagOpIn
+	tagOpNotExists
+)
+
+type tagRequirement struct {
+	key    string
+	op     tagOp
+	values []string
+}
+
+func (r tagRequirement) matches(t *topodatapb.Tablet) bool {
+	v, ok := t.Tags[r.key]
+	switch r.op {
+	case tagOpEquals:
+		return ok && v == r.values[0]
+	case tagOpNotEquals:
+		return !ok || v != r.values[0]
+	case tagOpIn:
+		if !ok {
+			return false
+		}
+		for _, want := range r.values {
+			if v == want {
+				return true
+			}
+		}
+		return false
+	case tagOpNotExists:
+		return !ok
+	default:
+		return false
+	}
+}
+
+func (r tagRequirement) String() string {
+	switch r.op {
+	case tagOpEquals:
+		return fmt.Sprintf("%s=%s", r.key, r.values[0])
+	case tagOpNotEquals:
+		return fmt.Sprintf("%s!=%s", r.key, r.values[0])
+	case tagOpIn:
+		return fmt.Sprintf("%s in (%s)", r.key, strings.Join(r.values, ","))
+	case tagOpNotExists:
+		return "!" + r.key
+	default:
+		return ""
+	}
+}
+
+// TagSelector is a compiled, Kubernetes-style label selector over a
+// tablet's Tags. Build one with ParseTagSelector.
+type TagSelector struct {
+	requirements []tagRequirement
+}
+
+// Matches returns true if the tablet satisfies every requirement in the
+// selector. A selector with no requirements matches everything.
+func (s *TagSelector) Matches(t *topodatapb.Tablet) bool {
+	for _, req := range s.requirements {
+		if !req.matches(t) {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns the selector in the same comma-separated form accepted by
+// ParseTagSelector.
+func (s *TagSelector) String() string {
+	frags := make([]string, len(s.requirements))
+	for i, req := range s.requirements {
+		frags[i] = req.String()
+	}
+	return strings.Join(frags, ",")
+}
+
+// ParseTagSelector parses a comma-separated, Kubernetes-style label selector
+// over tablet tags. Each comma-separated term is one of:
+//
+//	k=v       // tag k is present and equal to v
+//	k!=v      // tag k is absent, or present and not equal to v
+//	k in (v1,v2)  // tag k is present and equal to one of v1, v2
+//	!k        // tag k is absent
+//
+// All terms are ANDed together.
+func ParseTagSelector(selector string) (*TagSelector, error) {
+	selector = strings.TrimSpace(selector)
+	if selector == "" {
+		return &TagSelector{}, nil
+	}
+
+	terms, err := splitTagTerms(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	reqs := make([]tagRequirement, 0, len(terms))
+	for _, term := range terms {
+		req, err := parseTagTerm(term)
+		if err != nil {
+			return nil, vterrors.Wrapf(err, "invalid tag selector %q", selector)
+		}
+		reqs = append(reqs, req)
+	}
+	return &TagSelector{requirements: reqs}, nil
+}
+
+// splitTagTerms splits a selector on top-level commas, i.e. commas that are
+// not nested inside the parentheses of an "in (...)" term.
+func splitTagTerms(selector string) ([]string, error) {
+	var terms []string
+	depth := 0
+	start := 0
+	for i, r := range selector {
+		switch r {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth < 0 {
+				return nil, fmt.Errorf("unbalanced parentheses in tag selector %q", selector)
+			}
+		case ',':
+			if depth == 0 {
+				terms = append(terms, selector[start:i])
+				start = i + 1
+			}
+		}
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("unbalanced parentheses in tag selector %q", selector)
+	}
+	terms = append(terms, selector[start:])
+	return terms, nil
+}
+
+// tagInTermPattern anchors on the whole " in (...)" token, rather than
+// substring-matching "in", so that keys like "domain" or "origin" that
+// merely contain the letters "in" aren't mistaken for the in-operator.
+var tagInTermPattern = regexp.MustCompile(`^(\S+)\s+in\s*\(([^)]*)\)$`)
+
+func parseTagTerm(term string) (tagRequirement, error) {
+	term = strings.TrimSpace(term)
+	switch {
+	case strings.HasPrefix(term, "!"):
+		key := strings.TrimSpace(strings.TrimPrefix(term, "!"))
+		if key == "" {
+			return tagRequirement{}, fmt.Errorf("empty key in term %q", term)
+		}
+		return tagRequirement{key: key, op: tagOpNotExists}, nil
+
+	case strings.Contains(term, "!="):
+		key, value, _ := strings.Cut(term, "!=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if key == "" {
+			return tagRequirement{}, fmt.Errorf("empty key in term %q", term)
+		}
+		return tagRequirement{key: key, op: tagOpNotEquals, values: []string{value}}, nil
+
+	case tagInTermPattern.MatchString(term):
+		m := tagInTermPattern.FindStringSubmatch(term)
+		key := m[1]
+		var values []string
+		for _, v := range strings.Split(m[2], ",") {
+			v = strings.TrimSpace(v)
+			if v == "" {
+				return tagRequirement{}, fmt.Errorf("empty value in term %q", term)
+			}
+			values = append(values, v)
+		}
+		if len(values) == 0 {
+			return tagRequirement{}, fmt.Errorf("'in' term %q has no values", term)
+		}
+		return tagRequirement{key: key, op: tagOpIn, values: values}, nil
+
+	case strings.Contains(term, "="):
+		key, value, _ := strings.Cut(term, "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if key == "" {
+			return tagRequirement{}, fmt.Errorf("empty key in term %q", term)
+		}
+		return tagRequirement{key: key, op: tagOpEquals, values: []string{value}}, nil
+
+	default:
+		return tagRequirement{}, fmt.Errorf("unparseable tag term %q", term)
+	}
+}
+
+// TabletMatchesTagSelector parses selector and reports whether tablet
+// matches it. Callers that evaluate the same selector against many tablets
+// should call ParseTagSelector once and reuse the resulting TagSelector
+// instead.
+func TabletMatchesTagSelector(t *topodatapb.Tablet, selector string) (bool, error) {
+	sel, err := ParseTagSelector(selector)
+	if err != nil {
+		return false, err
+	}
+	return sel.Matches(t), nil
+}
+
+// TabletTagIndex provides O(1) lookup of tablet aliases by tag key/value,
+// built once from a list of tablets so that fleet-wide tag queries don't
+// need to re-scan every tablet on every call.
+type TabletTagIndex struct {
+	byKeyValue map[string]map[string]TabletAliasList
+}
+
+// NewTabletTagIndex builds a TabletTagIndex from tablets. Tablets with a nil
+// Alias are ignored, since there would be nothing useful to return from
+// Lookup for them.
+func NewTabletTagIndex(tablets []*topodatapb.Tablet) *TabletTagIndex {
+	idx := &TabletTagIndex{byKeyValue: make(map[string]map[string]TabletAliasList)}
+	for _, t := range tablets {
+		if t.Alias == nil {
+			continue
+		}
+		for k, v := range t.Tags {
+			if idx.byKeyValue[k] == nil {
+				idx.byKeyValue[k] = make(map[string]TabletAliasList)
+			}
+			idx.byKeyValue[k][v] = append(idx.byKeyValue[k][v], t.Alias)
+		}
+	}
+	for _, byValue := range idx.byKeyValue {
+		for v, aliases := range byValue {
+			sort.Sort(aliases)
+			byValue[v] = aliases
+		}
+	}
+	return idx
+}
+
+// Lookup returns the aliases of tablets tagged key=value, sorted by
+// TabletAliasList for deterministic CLI output. It returns nil if no
+// indexed tablet carries that tag/value pair.
+func (idx *TabletTagIndex) Lookup(key, value string) TabletAliasList {
+	return idx.byKeyValue[key][value]
+}
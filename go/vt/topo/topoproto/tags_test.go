@@ -0,0 +1,149 @@
+/*
+Copyright 2019 The Vitess Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package topoproto
+
+import (
+	"strings"
+	"testing"
+
+	topodatapb "vitess.io/vitess/go/vt/proto/topodata"
+)
+
+func tabletForTagTest(cell string, uid uint32, tags map[string]string) *topodatapb.Tablet {
+	return &topodatapb.Tablet{
+		Alias: &topodatapb.TabletAlias{Cell: cell, Uid: uid},
+		Tags:  tags,
+	}
+}
+
+func TestTabletHasTag(t *testing.T) {
+	tablet := tabletForTagTest("zone1", 1, map[string]string{"env": "prod"})
+
+	if !TabletHasTag(tablet, "env", "prod") {
+		t.Errorf("TabletHasTag(env=prod) = false, want true")
+	}
+	if TabletHasTag(tablet, "env", "staging") {
+		t.Errorf("TabletHasTag(env=staging) = true, want false")
+	}
+	if TabletHasTag(tablet, "missing", "") {
+		t.Errorf("TabletHasTag(missing) = true, want false")
+	}
+	if TabletHasTag(nil, "env", "prod") {
+		t.Errorf("TabletHasTag(nil) = true, want false")
+	}
+}
+
+func TestParseTagSelectorAndMatches(t *testing.T) {
+	tablet := tabletForTagTest("zone1", 1, map[string]string{
+		"env":    "prod",
+		"role":   "analytics",
+		"canary": "true",
+		"domain": "us",
+		"origin": "eu",
+		"pin":    "1",
+	})
+
+	cases := []struct {
+		selector string
+		want     bool
+		wantErr  bool
+	}{
+		{"", true, false},
+		{"env=prod", true, false},
+		{"env=staging", false, false},
+		{"env!=staging", true, false},
+		{"env!=prod", false, false},
+		{"missing!=anything", true, false},
+		{"role in (analytics,serving)", true, false},
+		{"role in (serving,batch)", false, false},
+		{"!missing", true, false},
+		{"!env", false, false},
+		{"env=prod,role in (analytics),!missing", true, false},
+		// Regression: keys that merely contain the substring "in" must not be
+		// mistaken for the "k in (...)" operator.
+		{"domain=us", true, false},
+		{"origin=eu", true, false},
+		{"pin=1", true, false},
+		{"domain in (us,eu)", true, false},
+		{"origin in (us,eu)", true, false},
+		{"malformed in (", false, true},
+		{"=noKey", false, true},
+		{"!", false, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.selector, func(t *testing.T) {
+			got, err := TabletMatchesTagSelector(tablet, c.selector)
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("TabletMatchesTagSelector(%q) returned no error, want one", c.selector)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("TabletMatchesTagSelector(%q) returned error: %v", c.selector, err)
+			}
+			if got != c.want {
+				t.Errorf("TabletMatchesTagSelector(%q) = %v, want %v", c.selector, got, c.want)
+			}
+		})
+	}
+}
+
+func TestTagSelectorString(t *testing.T) {
+	sel, err := ParseTagSelector("env=prod,role in (analytics,serving),!canary")
+	if err != nil {
+		t.Fatalf("ParseTagSelector() failed: %v", err)
+	}
+	got := sel.String()
+	if !strings.Contains(got, "env=prod") || !strings.Contains(got, "role in (analytics,serving)") || !strings.Contains(got, "!canary") {
+		t.Errorf("String() = %q, missing an expected term", got)
+	}
+}
+
+func TestTabletTagIndex(t *testing.T) {
+	tablets := []*topodatapb.Tablet{
+		tabletForTagTest("zone2", 2, map[string]string{"role": "analytics"}),
+		tabletForTagTest("zone1", 1, map[string]string{"role": "analytics"}),
+		tabletForTagTest("zone1", 3, map[string]string{"role": "serving"}),
+		tabletForTagTest("zone1", 4, nil),
+	}
+
+	idx := NewTabletTagIndex(tablets)
+
+	got := idx.Lookup("role", "analytics")
+	if len(got) != 2 {
+		t.Fatalf("Lookup(role=analytics) returned %d aliases, want 2", len(got))
+	}
+	// TabletAliasList sorts by cell then uid, so zone1-1 must come before zone2-2
+	// regardless of the order tablets were indexed in.
+	if got[0].Cell != "zone1" || got[0].Uid != 1 || got[1].Cell != "zone2" || got[1].Uid != 2 {
+		t.Errorf("Lookup(role=analytics) = %v, want sorted [zone1-1, zone2-2]", got.ToStringSlice())
+	}
+
+	if got := idx.Lookup("role", "serving"); len(got) != 1 || got[0].Uid != 3 {
+		t.Errorf("Lookup(role=serving) = %v, want [zone1-3]", got)
+	}
+
+	if got := idx.Lookup("role", "missing"); got != nil {
+		t.Errorf("Lookup(role=missing) = %v, want nil", got)
+	}
+
+	if got := idx.Lookup("missingkey", "x"); got != nil {
+		t.Errorf("Lookup(missingkey) = %v, want nil", got)
+	}
+}